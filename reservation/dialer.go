@@ -0,0 +1,400 @@
+package reservation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Dialer abstracts how Manager obtains a connection for a reservation key. The
+// default redis:// configuration always dials the same address; Sentinel and
+// Cluster URLs resolve to a dynamic address behind the same interface so Lock,
+// Release, and heartbeat never need topology-specific logic.
+type Dialer interface {
+	// Get returns a connection routable for key. The caller must Close it.
+	Get(key string) (redis.Conn, error)
+	// Do gets a connection for key, runs the command on it, and closes it.
+	Do(key string, commandName string, args ...interface{}) (interface{}, error)
+	// Refresh re-resolves the dialer's backing topology: the current master for
+	// Sentinel, the slot-to-node map for Cluster. It's a no-op for a plain
+	// single-node Dialer, which has no topology to resolve.
+	Refresh() error
+}
+
+// newDialer builds the Dialer implied by url's scheme: plain "host:port" or
+// "redis://host:port" dials a single node directly, "sentinel://master@host1,host2/db"
+// resolves the current master through Sentinel, and "cluster://host1,host2" hash-slots
+// keys across a Redis Cluster.
+func newDialer(url string, dialT, readT, writeT time.Duration) (Dialer, error) {
+	switch {
+	case strings.HasPrefix(url, "sentinel://"):
+		return newSentinelDialer(url, dialT, readT, writeT)
+	case strings.HasPrefix(url, "cluster://"):
+		return newClusterDialer(url, dialT, readT, writeT)
+	default:
+		addr := strings.TrimPrefix(url, "redis://")
+		return newPoolDialer(addr, dialT, readT, writeT), nil
+	}
+}
+
+// poolDialer is the default Dialer: every key routes to the same single-node pool.
+type poolDialer struct {
+	pool *redis.Pool
+}
+
+func newPoolDialer(addr string, dialT, readT, writeT time.Duration) *poolDialer {
+	return &poolDialer{
+		pool: redis.NewPool(func() (redis.Conn, error) {
+			return redis.DialTimeout("tcp", addr, dialT, readT, writeT)
+		}, 5),
+	}
+}
+
+func (d *poolDialer) Get(key string) (redis.Conn, error) {
+	return d.pool.Get(), nil
+}
+
+func (d *poolDialer) Do(key string, commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(commandName, args...)
+}
+
+func (d *poolDialer) Refresh() error { return nil }
+
+// sentinelDialer resolves the current master for a named Sentinel deployment and
+// re-resolves whenever a command comes back with a READONLY or MOVED error, which
+// is what a stale master connection looks like after a failover.
+type sentinelDialer struct {
+	sentinelAddrs        []string
+	masterName           string
+	db                   int
+	dialT, readT, writeT time.Duration
+
+	mu   sync.Mutex
+	pool *redis.Pool
+}
+
+func newSentinelDialer(url string, dialT, readT, writeT time.Duration) (*sentinelDialer, error) {
+	masterName, sentinelAddrs, db, err := parseSentinelURL(url)
+	if err != nil {
+		return nil, err
+	}
+	d := &sentinelDialer{
+		sentinelAddrs: sentinelAddrs,
+		masterName:    masterName,
+		db:            db,
+		dialT:         dialT,
+		readT:         readT,
+		writeT:        writeT,
+	}
+	if err := d.refresh(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// parseSentinelURL parses "sentinel://mymaster@host1:26379,host2:26379/0" into its
+// master name, sentinel addresses, and optional db index (default 0).
+func parseSentinelURL(raw string) (masterName string, sentinelAddrs []string, db int, err error) {
+	rest := strings.TrimPrefix(raw, "sentinel://")
+	parts := strings.SplitN(rest, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, 0, fmt.Errorf("invalid sentinel URL %q: expected sentinel://<master>@<host1>,<host2>[/<db>]", raw)
+	}
+	masterName = parts[0]
+	hosts := parts[1]
+
+	if idx := strings.LastIndex(hosts, "/"); idx != -1 {
+		dbStr := hosts[idx+1:]
+		hosts = hosts[:idx]
+		if dbStr != "" {
+			db, err = strconv.Atoi(dbStr)
+			if err != nil {
+				return "", nil, 0, fmt.Errorf("invalid sentinel URL %q: bad db index %q", raw, dbStr)
+			}
+		}
+	}
+
+	sentinelAddrs = strings.Split(hosts, ",")
+	return masterName, sentinelAddrs, db, nil
+}
+
+// refresh asks each known sentinel in turn for the current master address and
+// rebuilds the pool to point at it.
+func (d *sentinelDialer) refresh() error {
+	addr, err := d.resolveMaster()
+	if err != nil {
+		return err
+	}
+
+	db := d.db
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		conn, err := redis.DialTimeout("tcp", addr, d.dialT, d.readT, d.writeT)
+		if err != nil {
+			return nil, err
+		}
+		if db != 0 {
+			if _, err := conn.Do("SELECT", db); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}, 5)
+
+	d.mu.Lock()
+	old := d.pool
+	d.pool = pool
+	d.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (d *sentinelDialer) resolveMaster() (string, error) {
+	var lastErr error
+	for _, sentinelAddr := range d.sentinelAddrs {
+		conn, err := redis.DialTimeout("tcp", sentinelAddr, d.dialT, d.readT, d.writeT)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", d.masterName))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = fmt.Errorf("unexpected SENTINEL get-master-addr-by-name reply: %v", reply)
+			continue
+		}
+		return fmt.Sprintf("%s:%s", reply[0], reply[1]), nil
+	}
+	return "", fmt.Errorf("could not resolve master %q from any of %v: %s", d.masterName, d.sentinelAddrs, lastErr)
+}
+
+func (d *sentinelDialer) currentPool() *redis.Pool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pool
+}
+
+func (d *sentinelDialer) Get(key string) (redis.Conn, error) {
+	return d.currentPool().Get(), nil
+}
+
+func (d *sentinelDialer) Do(key string, commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	reply, doErr := conn.Do(commandName, args...)
+	conn.Close()
+	if !isRedirectError(doErr) {
+		return reply, doErr
+	}
+
+	// The master we had cached just told us it's no longer writable; re-resolve
+	// through Sentinel and retry once against the new master.
+	if refreshErr := d.Refresh(); refreshErr != nil {
+		return reply, doErr
+	}
+	conn, err = d.Get(key)
+	if err != nil {
+		return reply, doErr
+	}
+	defer conn.Close()
+	return conn.Do(commandName, args...)
+}
+
+// Refresh re-resolves the current master through Sentinel.
+func (d *sentinelDialer) Refresh() error {
+	return d.refresh()
+}
+
+func isRedirectError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "READONLY") || strings.Contains(msg, "MOVED")
+}
+
+// clusterDialer hash-slots keys across a Redis Cluster, routing each command to
+// the node that owns the key's slot per CLUSTER SLOTS.
+type clusterDialer struct {
+	seedAddrs            []string
+	dialT, readT, writeT time.Duration
+
+	mu    sync.Mutex
+	pools map[string]*redis.Pool
+	slots [16384]string
+}
+
+func newClusterDialer(url string, dialT, readT, writeT time.Duration) (*clusterDialer, error) {
+	seedAddrs := strings.Split(strings.TrimPrefix(url, "cluster://"), ",")
+	d := &clusterDialer{
+		seedAddrs: seedAddrs,
+		dialT:     dialT,
+		readT:     readT,
+		writeT:    writeT,
+		pools:     map[string]*redis.Pool{},
+	}
+	if err := d.refresh(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// refresh queries CLUSTER SLOTS from the first reachable seed node and rebuilds
+// the slot-to-node routing table.
+func (d *clusterDialer) refresh() error {
+	var lastErr error
+	for _, addr := range d.seedAddrs {
+		conn, err := redis.DialTimeout("tcp", addr, d.dialT, d.readT, d.writeT)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var slots [16384]string
+		for _, rawRange := range reply {
+			slotRange, err := redis.Values(rawRange, nil)
+			if err != nil || len(slotRange) < 3 {
+				continue
+			}
+			start, _ := redis.Int(slotRange[0], nil)
+			end, _ := redis.Int(slotRange[1], nil)
+			node, err := redis.Values(slotRange[2], nil)
+			if err != nil || len(node) < 2 {
+				continue
+			}
+			host, _ := redis.String(node[0], nil)
+			port, _ := redis.Int(node[1], nil)
+			nodeAddr := fmt.Sprintf("%s:%d", host, port)
+			for slot := start; slot <= end && slot < len(slots); slot++ {
+				slots[slot] = nodeAddr
+			}
+		}
+
+		d.mu.Lock()
+		d.slots = slots
+		d.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("could not fetch CLUSTER SLOTS from any of %v: %s", d.seedAddrs, lastErr)
+}
+
+func (d *clusterDialer) poolFor(addr string) *redis.Pool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if pool, ok := d.pools[addr]; ok {
+		return pool
+	}
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		return redis.DialTimeout("tcp", addr, d.dialT, d.readT, d.writeT)
+	}, 5)
+	d.pools[addr] = pool
+	return pool
+}
+
+func (d *clusterDialer) addrForKey(key string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.slots[clusterKeySlot(key)]
+}
+
+func (d *clusterDialer) Get(key string) (redis.Conn, error) {
+	addr := d.addrForKey(key)
+	if addr == "" {
+		if err := d.refresh(); err != nil {
+			return nil, err
+		}
+		addr = d.addrForKey(key)
+		if addr == "" {
+			return nil, fmt.Errorf("no cluster node owns the slot for key %q", key)
+		}
+	}
+	return d.poolFor(addr).Get(), nil
+}
+
+func (d *clusterDialer) Do(key string, commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := d.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	reply, doErr := conn.Do(commandName, args...)
+	conn.Close()
+	if doErr == nil || !strings.Contains(doErr.Error(), "MOVED") {
+		return reply, doErr
+	}
+
+	// The slot map moved since our last refresh (e.g. a resharding); refresh and
+	// retry once against the node CLUSTER SLOTS now says owns it.
+	if refreshErr := d.Refresh(); refreshErr != nil {
+		return reply, doErr
+	}
+	conn, err = d.Get(key)
+	if err != nil {
+		return reply, doErr
+	}
+	defer conn.Close()
+	return conn.Do(commandName, args...)
+}
+
+// Refresh re-fetches CLUSTER SLOTS and rebuilds the slot-to-node routing table.
+func (d *clusterDialer) Refresh() error {
+	return d.refresh()
+}
+
+// clusterKeySlot implements the Redis Cluster key-to-slot hashing: CRC16 of the
+// key (or the part inside "{...}" if present, per the hash tag convention) mod 16384.
+func clusterKeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % 16384
+}
+
+var crc16Table [256]uint16
+
+func init() {
+	const poly = 0x1021
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = (crc << 8) ^ crc16Table[((crc>>8)^uint16(s[i]))&0xFF]
+	}
+	return crc
+}
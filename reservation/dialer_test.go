@@ -0,0 +1,48 @@
+package reservation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSentinelURL(t *testing.T) {
+	master, addrs, db, err := parseSentinelURL("sentinel://mymaster@host1:26379,host2:26379")
+	assert.Nil(t, err)
+	assert.Equal(t, "mymaster", master)
+	assert.Equal(t, []string{"host1:26379", "host2:26379"}, addrs)
+	assert.Equal(t, 0, db)
+
+	master, addrs, db, err = parseSentinelURL("sentinel://mymaster@host1:26379/3")
+	assert.Nil(t, err)
+	assert.Equal(t, "mymaster", master)
+	assert.Equal(t, []string{"host1:26379"}, addrs)
+	assert.Equal(t, 3, db)
+
+	_, _, _, err = parseSentinelURL("sentinel://host1:26379")
+	assert.Error(t, err)
+
+	_, _, _, err = parseSentinelURL("sentinel://mymaster@")
+	assert.Error(t, err)
+
+	_, _, _, err = parseSentinelURL("sentinel://mymaster@host1:26379/notanumber")
+	assert.Error(t, err)
+}
+
+func TestCRC16(t *testing.T) {
+	// "123456789" is the standard CRC16/XMODEM check value used by the Redis
+	// Cluster spec's own test vectors.
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+}
+
+func TestClusterKeySlot(t *testing.T) {
+	slot := clusterKeySlot("somekey")
+	assert.True(t, slot >= 0 && slot < 16384)
+
+	// Keys sharing a hash tag must land in the same slot so multi-key commands
+	// on them can run on one node.
+	assert.Equal(t, clusterKeySlot("{user1000}.following"), clusterKeySlot("{user1000}.followers"))
+
+	// A key with no hash tag just hashes the whole key.
+	assert.Equal(t, int(crc16("foo"))%16384, clusterKeySlot("foo"))
+}
@@ -0,0 +1,55 @@
+package reservation
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusObserver is an Observer backed by Prometheus metrics, labeled by
+// resource. The counters and histogram are left for the caller to construct
+// and register so they can choose names, labels, and buckets that fit their
+// own metrics namespace; PrometheusObserver only knows how to drive them.
+type PrometheusObserver struct {
+	LockAcquiredTotal    *prometheus.CounterVec
+	LockContendedTotal   *prometheus.CounterVec
+	LockReleasedTotal    *prometheus.CounterVec
+	HeartbeatFailedTotal *prometheus.CounterVec
+	WaitDurationSeconds  prometheus.ObserverVec
+}
+
+// LockAcquired implements Observer.
+func (p *PrometheusObserver) LockAcquired(resource string) {
+	if p.LockAcquiredTotal != nil {
+		p.LockAcquiredTotal.WithLabelValues(resource).Inc()
+	}
+}
+
+// LockContended implements Observer.
+func (p *PrometheusObserver) LockContended(resource string) {
+	if p.LockContendedTotal != nil {
+		p.LockContendedTotal.WithLabelValues(resource).Inc()
+	}
+}
+
+// LockReleased implements Observer.
+func (p *PrometheusObserver) LockReleased(resource string) {
+	if p.LockReleasedTotal != nil {
+		p.LockReleasedTotal.WithLabelValues(resource).Inc()
+	}
+}
+
+// HeartbeatFailed implements Observer. The error itself isn't attached as a
+// label to avoid unbounded label cardinality; it's passed to Manager.OnLockLost.
+func (p *PrometheusObserver) HeartbeatFailed(resource string, err error) {
+	if p.HeartbeatFailedTotal != nil {
+		p.HeartbeatFailedTotal.WithLabelValues(resource).Inc()
+	}
+}
+
+// WaitDuration implements Observer.
+func (p *PrometheusObserver) WaitDuration(resource string, d time.Duration) {
+	if p.WaitDurationSeconds != nil {
+		p.WaitDurationSeconds.WithLabelValues(resource).Observe(d.Seconds())
+	}
+}
@@ -1,8 +1,12 @@
 package reservation
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -12,13 +16,61 @@ import (
 // Reservation is a type that represents a lock on a resource. At most one reservation
 // can exist for an individual resource at any time.
 type Reservation struct {
-	stopped bool
-	key     string
+	key      string
+	resource string
 	// exported so T_T can access it and confirm the reservation is held by the calling worker
-	Value   string
-	getConn func() redis.Conn
-	ttl     time.Duration
-	lg      logger.KayveeLogger
+	Value string
+	// Token is a fencing token: monotonically increasing for each successful Lock
+	// on a given resource, so a downstream system can reject a stale write from a
+	// reservation holder that lost its lock but doesn't know it yet. Validate it
+	// with Manager.ValidateToken.
+	Token    uint64
+	nodes    []Dialer
+	quorum   int
+	ttl      time.Duration
+	lg       logger.KayveeLogger
+	observer Observer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// Done returns a channel that's closed once the Reservation is no longer being
+// kept alive, whether because Release was called or because its heartbeat
+// stopped reaching quorum. Callers that hold a Reservation for a long-running
+// task should select on Done() and abort if it closes before the task finishes.
+func (res *Reservation) Done() <-chan struct{} {
+	return res.ctx.Done()
+}
+
+// Err returns the reason the Reservation stopped being kept alive, or nil if
+// it's still active or was stopped via a clean Release.
+func (res *Reservation) Err() error {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	return res.err
+}
+
+func (res *Reservation) isDone() bool {
+	select {
+	case <-res.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// fail records err as the reason the Reservation was lost and cancels it.
+func (res *Reservation) fail(err error) {
+	res.mu.Lock()
+	if res.err == nil {
+		res.err = err
+	}
+	res.mu.Unlock()
+	res.cancel()
 }
 
 // Manager is responsible for creating and extending reservations. When a Reservation
@@ -27,163 +79,411 @@ type Reservation struct {
 // after `Manager.TTL` time elapses.
 type Manager struct {
 	owner          string
-	pool           *redis.Pool
+	nodes          []Dialer
+	quorum         int
 	Heartbeat, TTL time.Duration
 	lg             logger.KayveeLogger
+
+	// OnLockLost, if set, is called whenever a Reservation's heartbeat stops
+	// reaching quorum, instead of the library killing the process. It runs in
+	// its own goroutine per call, so a slow callback can't stall other
+	// reservations' heartbeats.
+	OnLockLost func(*Reservation, error)
+
+	// WaitPolicy controls the backoff WaitUntilLock uses between retries.
+	// Defaults to defaultWaitPolicy.
+	WaitPolicy WaitPolicy
+
+	// Observer, if set, is notified of reservation lifecycle events so operators
+	// can graph contention and heartbeat health per resource. Nil by default.
+	Observer Observer
+
+	scheduler *scheduler
+}
+
+// WaitPolicy configures the exponential backoff WaitUntilLock uses while
+// retrying a contended resource: the n'th retry waits up to
+// min(Max, Min*Multiplier^n), and - if Jitter is set - a uniformly random
+// duration between 0 and that value, to avoid a thundering herd of workers
+// all retrying in lockstep.
+type WaitPolicy struct {
+	Min        time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     bool
 }
 
+var defaultWaitPolicy = WaitPolicy{
+	Min:        100 * time.Millisecond,
+	Max:        5 * time.Second,
+	Multiplier: 2,
+	Jitter:     true,
+}
+
+// Observer receives reservation lifecycle events so operators can graph
+// contention and heartbeat health per resource. Implementations commonly wrap
+// Prometheus metrics (see PrometheusObserver), but the interface itself has no
+// dependency on any particular metrics backend.
+type Observer interface {
+	// LockAcquired is called whenever Lock successfully acquires resource.
+	LockAcquired(resource string)
+	// LockContended is called whenever Lock finds resource already reserved.
+	LockContended(resource string)
+	// LockReleased is called whenever Release successfully releases resource.
+	LockReleased(resource string)
+	// HeartbeatFailed is called whenever a Reservation's heartbeat stops
+	// reaching quorum, with the same error passed to OnLockLost.
+	HeartbeatFailed(resource string, err error)
+	// WaitDuration is called after WaitUntilLock returns with the total time
+	// spent waiting for resource, including the time spent on the final Lock
+	// call, whether or not that call succeeded.
+	WaitDuration(resource string, d time.Duration)
+}
+
+const (
+	dialTimeout  = 15 * time.Second
+	readTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+
+	// defaultNodeTimeout is NewMultiManager's default dial/read/write timeout for
+	// every node in a multi-node (Redlock) configuration. Redlock nodes are
+	// expected to run across separate failure domains, so this leaves enough
+	// room for ordinary cross-AZ/cross-region jitter without mistaking a merely
+	// slow node for a dead one; deployments that can guarantee tighter latency
+	// between nodes can pass their own value to NewMultiManagerWithTimeout.
+	defaultNodeTimeout = 500 * time.Millisecond
+
+	// pingProbeKey is only used to pick a node to health-check at construction time;
+	// it never corresponds to an actual reservation.
+	pingProbeKey = "reservation-ping-probe"
+)
+
 func redisKey(resource string) string {
 	return fmt.Sprintf("reservation-%s", resource)
 }
 
+// casDeleteScript deletes key only if its current value still matches the owner
+// that set it, so a reservation holder can never clobber a lock someone else
+// has since acquired.
+var casDeleteScript = redis.NewScript(1, `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+else
+	return 0
+end`)
+
+// casExpireScript extends key's TTL only if its current value still matches the
+// owner that set it.
+var casExpireScript = redis.NewScript(1, `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+else
+	return 0
+end`)
+
+// tokenSetScript mints a fencing token (INCR on the resource's token counter)
+// and, in the same round trip, SETs the reservation key to "<owner>:<token>"
+// if it isn't already held - one atomic operation per node instead of two
+// separate ones, so a Lock call doesn't pay for an extra network round trip
+// to every node just to generate the token. It always returns the token it
+// incremented, even when the SET loses to an existing reservation, since the
+// counter advances regardless.
+var tokenSetScript = redis.NewScript(2, `
+local token = redis.call("incr", KEYS[1])
+local val = ARGV[1] .. ":" .. token
+local set = redis.call("set", KEYS[2], val, "PX", ARGV[2], "NX")
+if set then
+	return {token, 1}
+else
+	return {token, 0}
+end`)
+
+// fanOut runs fn against every node in parallel and returns the number of nodes
+// for which fn reported success. A node that errors (including timing out,
+// since pools are dialed with a bounded timeout) counts as not successful.
+func fanOut(nodes []Dialer, key string, fn func(redis.Conn) (bool, error)) int {
+	results := make(chan bool, len(nodes))
+	for _, node := range nodes {
+		node := node
+		go func() {
+			results <- fanOutOne(node, key, fn)
+		}()
+	}
+	successes := 0
+	for range nodes {
+		if <-results {
+			successes++
+		}
+	}
+	return successes
+}
+
+// fanOutOne runs fn against a single node, retrying once after a topology
+// refresh if fn's command fails with a Sentinel/Cluster redirect error
+// (READONLY/MOVED). fanOut talks to raw connections (fn often runs a Lua
+// script via redis.Script.Do, which needs a redis.Conn rather than a
+// commandName/args pair), so it can't route through Dialer.Do the way
+// ValidateToken's GET and newManager's PING do; this gives it the same
+// failover recovery.
+func fanOutOne(node Dialer, key string, fn func(redis.Conn) (bool, error)) bool {
+	conn, err := node.Get(key)
+	if err != nil {
+		return false
+	}
+	ok, err := fn(conn)
+	conn.Close()
+	if err == nil {
+		return ok
+	}
+	if !isRedirectError(err) {
+		return false
+	}
+
+	if refreshErr := node.Refresh(); refreshErr != nil {
+		return false
+	}
+	conn, err = node.Get(key)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	ok, err = fn(conn)
+	return err == nil && ok
+}
+
 // NewManager returns a new Manager, or an error if a connection to the supplied
 // Redis server cannot be made.
 func NewManager(redisURL, owner string) (*Manager, error) {
-	// Open redis pool
-	redisPool := redis.NewPool(func() (redis.Conn, error) {
-		return redis.DialTimeout("tcp", redisURL, 15*time.Second, 10*time.Second, 10*time.Second)
-	}, 5)
+	return newManager([]string{redisURL}, owner, dialTimeout, readTimeout, writeTimeout)
+}
 
-	// Get a conn and ping so we fail immediately if the URL is wrong
-	conn := redisPool.Get()
-	defer conn.Close()
-	if _, err := conn.Do("PING"); err != nil {
-		return nil, fmt.Errorf("Error connecting to redis: %s", err)
+// NewMultiManager returns a new Manager that spreads reservations across N independent
+// Redis instances following the Redlock algorithm: a Reservation is only considered
+// acquired once a majority of the nodes accept it within the acquisition window. This
+// tolerates the failure of a minority of nodes without losing the mutual-exclusion
+// guarantee that a single Redis instance can't provide on its own.
+func NewMultiManager(urls []string, owner string) (*Manager, error) {
+	return NewMultiManagerWithTimeout(urls, owner, defaultNodeTimeout)
+}
+
+// NewMultiManagerWithTimeout is NewMultiManager with an explicit dial/read/write
+// timeout for every node, for deployments whose nodes' network latency doesn't
+// fit defaultNodeTimeout.
+func NewMultiManagerWithTimeout(urls []string, owner string, nodeTimeout time.Duration) (*Manager, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("NewMultiManager requires at least one redis URL")
+	}
+	return newManager(urls, owner, nodeTimeout, nodeTimeout, nodeTimeout)
+}
+
+func newManager(urls []string, owner string, dialT, readT, writeT time.Duration) (*Manager, error) {
+	nodes := make([]Dialer, len(urls))
+	for i, url := range urls {
+		dialer, err := newDialer(url, dialT, readT, writeT)
+		if err != nil {
+			return nil, fmt.Errorf("Error connecting to redis: %s", err)
+		}
+		nodes[i] = dialer
+	}
+
+	// Ping each node so we fail immediately if a URL is wrong
+	for _, node := range nodes {
+		if _, err := node.Do(pingProbeKey, "PING"); err != nil {
+			return nil, fmt.Errorf("Error connecting to redis: %s", err)
+		}
 	}
 
-	return &Manager{
-		Heartbeat: 15 * time.Minute,
-		TTL:       4 * time.Hour,
-		owner:     owner,
-		pool:      redisPool,
+	manager := &Manager{
+		Heartbeat:  15 * time.Minute,
+		TTL:        4 * time.Hour,
+		WaitPolicy: defaultWaitPolicy,
+		owner:      owner,
+		nodes:      nodes,
+		quorum:     len(nodes)/2 + 1,
 		lg: logger.NewWithContext(owner, logger.M{
 			"via":    "go-redis-reservation",
 			"job_id": os.Getenv("JOB_ID"),
 		}),
-	}, nil
+	}
+	manager.scheduler = newScheduler(manager)
+	return manager, nil
 }
 
 // Lock creates a Reservation for `resource`, or returns an error if there already exists a
-// Reservation for that resource.
+// Reservation for that resource. When the Manager was created with NewMultiManager, the
+// reservation is only acquired once a majority of the nodes accept the SET within the
+// acquisition window (Redlock); with NewManager there is a single node, so a majority is
+// simply that one node.
 func (manager *Manager) Lock(resource string) (*Reservation, error) {
 	key := redisKey(resource)
-	val := fmt.Sprintf("%s-%s", manager.owner, os.Getenv("JOB_ID"))
+	tKey := tokenKey(resource)
+	ownerID := fmt.Sprintf("%s-%s", manager.owner, os.Getenv("JOB_ID"))
+	start := time.Now()
 
-	// Get connection
-	conn := manager.pool.Get()
-	defer conn.Close()
+	var tokenMu sync.Mutex
+	var token uint64
+	// contended counts nodes that answered but already held the key.
+	contended := 0
+	successes := fanOut(manager.nodes, key, func(conn redis.Conn) (bool, error) {
+		reply, err := redis.Ints(tokenSetScript.Do(conn, tKey, key, ownerID, manager.TTL.Milliseconds()))
+		if err != nil || len(reply) != 2 {
+			return false, err
+		}
+		nodeToken, set := uint64(reply[0]), reply[1] == 1
 
-	// Try to set the reservation
-	success, err := conn.Do(
-		"SET", key, val,
-		"EX", manager.TTL.Seconds(),
-		"NX")
-	if err != nil {
-		manager.lg.ErrorD("redis-error", logger.M{"key": key, "resource": resource, "err": err.Error()})
-		return nil, fmt.Errorf("Error with SET command: %s", err.Error())
-	}
-	if success == nil {
-		manager.lg.InfoD("reservation-exists", logger.M{"key": key, "resource": resource})
+		tokenMu.Lock()
+		if nodeToken > token {
+			token = nodeToken
+		}
+		if !set {
+			contended++
+		}
+		tokenMu.Unlock()
+
+		return set, nil
+	})
+	val := fmt.Sprintf("%s:%d", ownerID, token)
+
+	// drift accounts for clock drift between this process and the redis nodes, and
+	// for the time already spent acquiring the lock, so the TTL we hand back never
+	// outlives what's actually still set in redis.
+	drift := time.Duration(float64(manager.TTL)*0.01) + 2*time.Millisecond
+	elapsed := time.Since(start)
+	effectiveTTL := manager.TTL - elapsed - drift
+
+	if successes < manager.quorum || effectiveTTL <= 0 {
+		// Best-effort cleanup on every node, including ones that didn't respond in
+		// time, so a partial acquisition doesn't linger until TTL.
+		go fanOut(manager.nodes, key, func(conn redis.Conn) (bool, error) {
+			n, err := redis.Int(casDeleteScript.Do(conn, key, val))
+			return n == 1, err
+		})
+		if contended == 0 {
+			// No node reported the key as held: the nodes failed or were too slow.
+			manager.lg.ErrorD("redis-error", logger.M{
+				"key": key, "resource": resource, "acks": successes, "quorum": manager.quorum,
+			})
+			return nil, fmt.Errorf("Error acquiring reservation for resource %s: %d/%d nodes acknowledged within the acquisition window", resource, successes, len(manager.nodes))
+		}
+		manager.lg.InfoD("reservation-exists", logger.M{
+			"key": key, "resource": resource, "acks": successes, "quorum": manager.quorum,
+		})
+		if manager.Observer != nil {
+			manager.Observer.LockContended(resource)
+		}
 		return nil, fmt.Errorf("Reservation already exists for resource %s", resource)
 	}
 
 	// Make new reservation
+	ctx, cancel := context.WithCancel(context.Background())
 	res := &Reservation{
-		key:     key,
-		Value:   val,
-		getConn: manager.pool.Get,
-		ttl:     manager.TTL,
-		lg:      manager.lg,
-	}
-
-	// Set up heartbeat in background
-	go func() {
-		for _ = range time.Tick(manager.Heartbeat) {
-			if res.stopped {
-				break
-			}
-			// Panic if err; no way to handle the error gracefully when this runs in the background
-			success, err := res.heartbeat()
-			if err != nil {
-				panic(err)
-			}
-			if success != 1 {
-				panic(fmt.Errorf("Got code %d when attempting to extend reservation", success))
-			}
-		}
-	}()
+		key:      key,
+		resource: resource,
+		Value:    val,
+		Token:    token,
+		nodes:    manager.nodes,
+		quorum:   manager.quorum,
+		ttl:      effectiveTTL,
+		lg:       manager.lg,
+		observer: manager.Observer,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	// Hand the reservation to the manager's heartbeat scheduler instead of
+	// spawning a goroutine per lock.
+	manager.scheduler.schedule(res, manager.Heartbeat)
+
+	if manager.Observer != nil {
+		manager.Observer.LockAcquired(resource)
+	}
 
 	return res, nil
 }
 
-// WaitUntilLock creates a Reservation for `resource`, or waits until it can do so.
+// WaitUntilLock creates a Reservation for `resource`, or waits until it can do so,
+// retrying with exponential backoff (and, by default, full jitter) per
+// manager.WaitPolicy so that many workers waiting on the same resource don't all
+// retry in lockstep.
 func (manager *Manager) WaitUntilLock(resource string) (*Reservation, error) {
 	reservationAlreadyExists := func(err error) bool {
 		return fmt.Sprintf("%s", err) == fmt.Sprintf("Reservation already exists for resource %s", resource)
 	}
 
+	start := time.Now()
+	policy := manager.WaitPolicy
+	attempt := 0
+
 	res, err := manager.Lock(resource)
 	for reservationAlreadyExists(err) {
 		manager.lg.InfoD("reservation-attempted", logger.M{
 			"key":      redisKey(resource),
 			"resource": resource})
-		time.Sleep(time.Second)
+		time.Sleep(policy.backoff(attempt))
+		attempt++
 		res, err = manager.Lock(resource)
 	}
 	if err == nil {
 		manager.lg.InfoD("reservation-acquired", logger.M{"key": res.key, "resource": resource})
 	}
+	if manager.Observer != nil {
+		manager.Observer.WaitDuration(resource, time.Since(start))
+	}
 	return res, err
 }
 
+// backoff returns how long to sleep before retry number attempt (0-indexed).
+func (p WaitPolicy) backoff(attempt int) time.Duration {
+	wait := time.Duration(float64(p.Min) * math.Pow(p.Multiplier, float64(attempt)))
+	if wait > p.Max || wait <= 0 {
+		wait = p.Max
+	}
+	if !p.Jitter || wait <= 0 {
+		return wait
+	}
+	return time.Duration(rand.Int63n(int64(wait)))
+}
+
 // Release ends a lock on a resource. Release returns `nil` if release was successful or
 // an `error` if not. In the event of an error, the reservation will be removed from Redis after
 // `Reservation.ttl` expires.
 func (res *Reservation) Release() error {
-	conn := res.getConn()
-	defer conn.Close()
+	res.cancel()
 
-	_, err := redis.Int(conn.Do("DEL", res.key))
-	// Always release lock so reservation will expire after TTL if delete fails
-	res.stopped = true
+	successes := fanOut(res.nodes, res.key, func(conn redis.Conn) (bool, error) {
+		n, err := redis.Int(casDeleteScript.Do(conn, res.key, res.Value))
+		return n == 1, err
+	})
 
-	if err != nil {
+	if successes < res.quorum {
 		res.lg.ErrorD("reservation-failed-to-release", logger.M{
 			"key":               res.key,
 			"reservation-value": res.Value})
-		return fmt.Errorf("Error deleting reservation key for %s: %s", res.key, err.Error())
+		return fmt.Errorf("Error deleting reservation key for %s: released on %d/%d nodes", res.key, successes, len(res.nodes))
 	}
 
 	res.lg.InfoD("reservation-released", logger.M{
 		"key":               res.key,
 		"reservation-value": res.Value})
+	if res.observer != nil {
+		res.observer.LockReleased(res.resource)
+	}
 	return nil
 }
 
 func (res *Reservation) heartbeat() (int, error) {
-	// Get connection
-	conn := res.getConn()
-	defer conn.Close()
-
-	// Check that the reservation still exists and error if we don't have it
-	resValue, err := redis.String(conn.Do("GET", res.key))
-	if err != nil {
-		return -1, fmt.Errorf("Could not fetch owner of reservation %s: ERR %s", res.key, err.Error())
-	}
-	if resValue != res.Value {
-		return -1, fmt.Errorf("Reservation for %s has unknown owner %s", res.key, resValue)
-	}
+	successes := fanOut(res.nodes, res.key, func(conn redis.Conn) (bool, error) {
+		n, err := redis.Int(casExpireScript.Do(conn, res.key, res.Value, res.ttl.Milliseconds()))
+		return n == 1, err
+	})
 
-	// Extend reservation
-	success, err := redis.Int(conn.Do("EXPIRE", res.key, res.ttl.Seconds()))
-	if err != nil {
-		return -1, fmt.Errorf("Could not extend reservation %s: ERR %s", res.key, err.Error())
-	}
 	res.lg.InfoD("reservation-extended", logger.M{
 		"key":      res.key,
 		"val":      res.Value,
 		"duration": res.ttl.String(),
+		"acks":     successes,
+		"quorum":   res.quorum,
 	})
 
-	return success, nil
+	return successes, nil
 }
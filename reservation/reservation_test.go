@@ -33,19 +33,16 @@ func setUp(t *testing.T) (*Manager, string) {
 	return manager, resourceID
 }
 
-func TestSourceExposed(t *testing.T) {
+func TestValueExposed(t *testing.T) {
 	manager, resourceID := setUp(t)
 
 	// Create a reservation
 	reservation, err := manager.Lock(resourceID)
 	assert.Nil(t, err)
 
-	hostname, err := os.Hostname()
-	assert.Nil(t, err)
-
-	expectedKeySubstr := fmt.Sprintf("%s-%s", hostname, manager.owner)
+	expectedValuePrefix := fmt.Sprintf("%s-%s", manager.owner, os.Getenv("JOB_ID"))
 	// Assert we can access the reservation value
-	assert.Contains(t, reservation.Source, expectedKeySubstr)
+	assert.Contains(t, reservation.Value, expectedValuePrefix)
 }
 
 func TestManagerLockCreate(t *testing.T) {
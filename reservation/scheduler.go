@@ -0,0 +1,172 @@
+package reservation
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// noDueItemsWait is how long the scheduler's timer sleeps for when its heap is
+// empty; it's only ever "a while", since schedule always wakes the loop early
+// when it has something more pressing to add.
+const noDueItemsWait = time.Hour
+
+// maxConcurrentHeartbeats bounds how many heartbeats tick() runs at once, so a
+// fleet of thousands of reservations whose heartbeat windows line up doesn't
+// serialize behind one slow (not down) node.
+const maxConcurrentHeartbeats = 64
+
+// schedulerItem is a Reservation's next-heartbeat slot in the scheduler's heap.
+type schedulerItem struct {
+	next time.Time
+	res  *Reservation
+}
+
+type schedulerHeap []*schedulerItem
+
+func (h schedulerHeap) Len() int            { return len(h) }
+func (h schedulerHeap) Less(i, j int) bool  { return h[i].next.Before(h[j].next) }
+func (h schedulerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *schedulerHeap) Push(x interface{}) { *h = append(*h, x.(*schedulerItem)) }
+func (h *schedulerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// scheduler drives every Reservation's heartbeat from a single goroutine, using a
+// min-heap keyed on next-heartbeat time and a single timer, instead of one
+// goroutine per Reservation. A failed heartbeat cancels that Reservation's
+// context and reports to Manager.OnLockLost rather than panicking the process.
+type scheduler struct {
+	manager *Manager
+
+	mu    sync.Mutex
+	items schedulerHeap
+	timer *time.Timer
+	wake  chan struct{}
+	sem   chan struct{}
+}
+
+func newScheduler(manager *Manager) *scheduler {
+	s := &scheduler{
+		manager: manager,
+		timer:   time.NewTimer(noDueItemsWait),
+		wake:    make(chan struct{}, 1),
+		sem:     make(chan struct{}, maxConcurrentHeartbeats),
+	}
+	go s.run()
+	return s
+}
+
+// schedule adds res to the heap so its next heartbeat fires after `in`.
+func (s *scheduler) schedule(res *Reservation, in time.Duration) {
+	s.mu.Lock()
+	heap.Push(&s.items, &schedulerItem{next: time.Now().Add(in), res: res})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) run() {
+	for {
+		select {
+		case <-s.timer.C:
+		case <-s.wake:
+			if !s.timer.Stop() {
+				select {
+				case <-s.timer.C:
+				default:
+				}
+			}
+		}
+		s.tick()
+		s.resetTimer()
+	}
+}
+
+// tick dispatches every Reservation whose next heartbeat is due to its own
+// goroutine, capped at maxConcurrentHeartbeats concurrently, so one slow node
+// can't stall the heartbeats of reservations that don't even use it.
+func (s *scheduler) tick() {
+	for {
+		s.mu.Lock()
+		if len(s.items) == 0 || s.items[0].next.After(time.Now()) {
+			s.mu.Unlock()
+			return
+		}
+		item := heap.Pop(&s.items).(*schedulerItem)
+		s.mu.Unlock()
+
+		s.sem <- struct{}{}
+		go func() {
+			defer func() { <-s.sem }()
+			s.process(item)
+		}()
+	}
+}
+
+// process sends item's Reservation's heartbeat, rescheduling it on success or
+// failing it (cancelling its context and invoking Manager.OnLockLost)
+// otherwise. It runs off the scheduler goroutine under maxConcurrentHeartbeats,
+// so it wakes the scheduler itself after rescheduling rather than relying on
+// run()'s already-in-flight resetTimer to notice the change.
+func (s *scheduler) process(item *schedulerItem) {
+	res := item.res
+	if res.isDone() {
+		return
+	}
+
+	successes, err := res.heartbeat()
+	if err == nil && successes < res.quorum {
+		err = fmt.Errorf("Got ack from %d/%d nodes when attempting to extend reservation", successes, len(res.nodes))
+	}
+	if err != nil {
+		// Release may have raced this heartbeat and won: its CAS-delete can land
+		// before our CAS-expire, which makes heartbeat() look like a failure even
+		// though the reservation was torn down cleanly. Don't report a lock loss
+		// for a reservation the caller already released.
+		if res.isDone() {
+			return
+		}
+		res.fail(err)
+		if s.manager.Observer != nil {
+			s.manager.Observer.HeartbeatFailed(res.resource, err)
+		}
+		if s.manager.OnLockLost != nil {
+			go s.manager.OnLockLost(res, err)
+		}
+		return
+	}
+
+	item.next = time.Now().Add(s.manager.Heartbeat)
+	s.mu.Lock()
+	heap.Push(&s.items, item)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) resetTimer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.items) == 0 {
+		s.timer.Reset(noDueItemsWait)
+		return
+	}
+	d := time.Until(s.items[0].next)
+	if d < 0 {
+		d = 0
+	}
+	s.timer.Reset(d)
+}
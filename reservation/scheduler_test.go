@@ -0,0 +1,31 @@
+package reservation
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerHeapOrdering(t *testing.T) {
+	now := time.Unix(0, 0)
+	items := schedulerHeap{}
+	heap.Init(&items)
+
+	heap.Push(&items, &schedulerItem{next: now.Add(3 * time.Second)})
+	heap.Push(&items, &schedulerItem{next: now.Add(1 * time.Second)})
+	heap.Push(&items, &schedulerItem{next: now.Add(2 * time.Second)})
+
+	var popped []time.Time
+	for items.Len() > 0 {
+		item := heap.Pop(&items).(*schedulerItem)
+		popped = append(popped, item.next)
+	}
+
+	assert.Equal(t, []time.Time{
+		now.Add(1 * time.Second),
+		now.Add(2 * time.Second),
+		now.Add(3 * time.Second),
+	}, popped)
+}
@@ -0,0 +1,14 @@
+package reservation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueHasToken(t *testing.T) {
+	assert.True(t, valueHasToken("test-worker-job1:42", 42))
+	assert.False(t, valueHasToken("test-worker-job1:42", 43))
+	assert.False(t, valueHasToken("test-worker-job1", 42))
+	assert.False(t, valueHasToken("test-worker-job1:notanumber", 42))
+}
@@ -0,0 +1,37 @@
+package reservation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitPolicyBackoffNoJitter(t *testing.T) {
+	policy := WaitPolicy{
+		Min:        100 * time.Millisecond,
+		Max:        1 * time.Second,
+		Multiplier: 2,
+		Jitter:     false,
+	}
+
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(0))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 400*time.Millisecond, policy.backoff(2))
+	// Capped at Max once Min*Multiplier^attempt exceeds it.
+	assert.Equal(t, 1*time.Second, policy.backoff(10))
+}
+
+func TestWaitPolicyBackoffJitter(t *testing.T) {
+	policy := WaitPolicy{
+		Min:        100 * time.Millisecond,
+		Max:        1 * time.Second,
+		Multiplier: 2,
+		Jitter:     true,
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		wait := policy.backoff(attempt)
+		assert.True(t, wait >= 0 && wait <= policy.Max, "backoff(%d) = %s out of range", attempt, wait)
+	}
+}